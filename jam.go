@@ -1,26 +1,129 @@
 package logjam
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// maxPooledBuffer is the largest scratch buffer Output will return to the
+// pool. Anything bigger is an outlier (e.g. a huge one-off Printf) and is
+// left for the garbage collector instead of bloating the pool, mirroring
+// the guard fmt uses around its own pp pool.
+const maxPooledBuffer = 64 << 10 // 64KiB
+
+var bufferPool = sync.Pool{
+	New: func() any { b := make([]byte, 0, 256); return &b },
+}
+
+func getBuffer() *[]byte {
+	b := bufferPool.Get().(*[]byte)
+	*b = (*b)[:0]
+	return b
+}
+
+func putBuffer(b *[]byte) {
+	if cap(*b) > maxPooledBuffer {
+		return
+	}
+	bufferPool.Put(b)
+}
+
+type heatFunc = func([]byte) []byte
+
 const (
 	reset        = "\033[0m"
+	green        = "\033[1;32m"
 	yellow       = "\033[1;33m"
+	cyan         = "\033[1;36m"
 	red          = "\033[1;31m"
+	magenta      = "\033[1;35m"
 	announcement = "\033[1;32m"
 
-	cold int = iota
+	cold = iota
 	coolingDown
 	heatingUp
 	onFire
 )
 
+// These flags define which text to prefix to each log entry generated by
+// the Logger. They mirror the bits defined by the standard library's log
+// package so that logjam can be dropped in wherever log.Logger is used.
+const (
+	Ldate         = 1 << iota // the date in the local time zone: 2009/01/23
+	Ltime                     // the time in the local time zone: 01:23:23
+	Lmicroseconds             // microsecond resolution: 01:23:23.123123.  assumes Ltime.
+	Llongfile                 // full file name and line number: /a/b/c/d.go:23
+	Lshortfile                // final file name element and line number: d.go:23. overrides Llongfile
+	LUTC                      // if Ldate or Ltime is set, use UTC rather than the local time zone
+	Lmsgprefix                // move the "prefix" from the beginning of the line to before the message
+	Llevel                    // prefix the message with a "[LEVEL] " tag, for the leveled Debugf/Infof/Warnf/Errorf family
+	Lshortcolor               // colorize just the "[LEVEL] " tag with the level's color
+	Llongcolor                // colorize the whole line with the level's color
+	LstdFlags     = Ldate | Ltime
+)
+
+// Level identifies the severity of a leveled log entry.
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+	Panic
+	Fatal
+)
+
+// String returns the tag text used in the "[LEVEL] " header, e.g. "INFO".
+func (lv Level) String() string {
+	switch lv {
+	case Debug:
+		return "DEBUG"
+	case Info:
+		return "INFO"
+	case Warn:
+		return "WARN"
+	case Error:
+		return "ERROR"
+	case Panic:
+		return "PANIC"
+	case Fatal:
+		return "FATAL"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// color returns the ANSI color code associated with the level, following
+// lunny/log's green/cyan/yellow/red/magenta convention. Panic and Fatal
+// share magenta since both indicate the process is about to go away.
+func (lv Level) color() string {
+	switch lv {
+	case Debug:
+		return green
+	case Info:
+		return cyan
+	case Warn:
+		return yellow
+	case Error:
+		return red
+	default:
+		return magenta
+	}
+}
+
 func blazing(txt []byte) []byte {
 	var buf bytes.Buffer
 	buf.WriteString(red)
@@ -60,205 +163,820 @@ func fire(txt []byte) []byte {
 }
 
 type Logger struct {
-	mu     sync.Mutex // ensures atomic writes; protects the following fields
-	prefix string     // prefix to write at beginning of each line
-	term   bool
-	out    io.Writer // destination for output
-	buf    []byte
-
-	state          int
-	period         int64
-	firePeriod     int64
-	rate           int
-	rateHeatingUp  int
-	rateOnFire     int
-	periodsBlazing int64
-	announce       string
-	heat           func([]byte) []byte
+	mu  sync.Mutex // serializes the final writes to out and any sinks, to preserve line ordering
+	out atomic.Pointer[io.Writer]
+
+	// sinks holds additional fan-out destinations added with AddSink, or
+	// nil if there are none.
+	sinks atomic.Pointer[[]*sink]
+	// isDiscard is cached whenever out or the sink list changes, so Output
+	// can skip formatting, header building, and heat computation entirely
+	// once every destination is io.Discard, following the standard
+	// library's own log.Logger optimization.
+	isDiscard atomic.Bool
+
+	prefix  atomic.Pointer[string]
+	flag    atomic.Int64
+	term    atomic.Bool  // whether out looks like a terminal, auto-detected
+	noColor atomic.Bool  // force-disable all ANSI codes regardless of term
+	level   atomic.Int64 // minimum Level that Debugf/Infof/Warnf/Errorf will emit
+
+	// periodRate packs the current one-second period (high 32 bits, a
+	// truncated Unix timestamp) and the number of calls seen during it
+	// (low 32 bits) into a single word so updateHeat can detect period
+	// rollover and count calls with one CAS instead of taking mu.
+	periodRate atomic.Uint64
+
+	state          atomic.Int64
+	firePeriod     atomic.Int64
+	rateHeatingUp  atomic.Int64
+	rateOnFire     atomic.Int64
+	periodsBlazing atomic.Int64
+	lastRate       atomic.Int64 // rate last passed to updateHeat (the completed period's count plus the call that ended it), for FormatJSON
+	announce       atomic.Pointer[string]
+	heat           atomic.Pointer[heatFunc]
+	heatName       atomic.Pointer[string] // name of the active heat func, for FormatJSON
+
+	format atomic.Int64 // Format: FormatText or FormatJSON
 }
 
 func New(out io.Writer, prefix string) *Logger {
-	return &Logger{
-		out:            out,
-		prefix:         prefix,
-		term:           true,
-		state:          cold,
-		rateHeatingUp:  10,
-		rateOnFire:     20,
-		periodsBlazing: 5,
-	}
+	l := &Logger{}
+	l.out.Store(&out)
+	l.prefix.Store(&prefix)
+	l.flag.Store(LstdFlags)
+	l.term.Store(isTerminal(out))
+	l.level.Store(int64(Debug))
+	l.state.Store(int64(cold))
+	l.rateHeatingUp.Store(10)
+	l.rateOnFire.Store(20)
+	l.periodsBlazing.Store(5)
+	l.clearHeat()
+	l.format.Store(int64(FormatText))
+	l.updateIsDiscard()
+	return l
+}
+
+// Format selects the Logger's output encoding.
+type Format int64
+
+const (
+	// FormatText is the default: a plain, optionally colorized line.
+	FormatText Format = iota
+	// FormatJSON emits one JSON object per line, including the current
+	// heat state and rate-per-second, and never emits ANSI escapes.
+	FormatJSON
+)
+
+// SetFormat selects between FormatText (the default) and FormatJSON.
+func (l *Logger) SetFormat(f Format) {
+	l.format.Store(int64(f))
 }
 
 func (l *Logger) SetOutput(w io.Writer) {
+	l.out.Store(&w)
+	l.term.Store(isTerminal(w))
+	l.updateIsDiscard()
+}
+
+// sink is one additional fan-out destination added with AddSink.
+type sink struct {
+	w         io.Writer
+	stripANSI bool
+	minLevel  int64
+}
+
+// SinkOptions controls the formatting policy applied to one AddSink
+// destination, independent of the primary output's.
+type SinkOptions struct {
+	// StripANSI removes ANSI color codes before writing to this sink, for
+	// destinations like files or syslog that shouldn't see terminal colors.
+	StripANSI bool
+	// MinLevel filters out leveled entries (Debugf/Infof/Warnf/Errorf and
+	// the Panic/Fatal family) below this level for this sink. Unleveled
+	// entries written through Output/Print* are never filtered here.
+	MinLevel int
+	// BufferSize wraps w in a bufio.Writer of this size; 0 leaves w
+	// unbuffered. Callers that set this must call Logger.Flush before
+	// exiting, or lines still sitting in the buffer are lost.
+	BufferSize int
+}
+
+// AddSink adds an additional destination that every subsequent log entry is
+// also written to, alongside the primary output set by New/SetOutput. This
+// lets a caller tee colored fire output to a terminal while writing plain,
+// uncolored, level-filtered lines to a file or syslog.
+func (l *Logger) AddSink(w io.Writer, opts SinkOptions) {
+	if opts.BufferSize > 0 {
+		w = bufio.NewWriterSize(w, opts.BufferSize)
+	}
+	s := &sink{w: w, stripANSI: opts.StripANSI, minLevel: int64(opts.MinLevel)}
+
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	l.out = w
+	var next []*sink
+	if old := l.sinks.Load(); old != nil {
+		next = append(next, *old...)
+	}
+	next = append(next, s)
+	l.sinks.Store(&next)
+	l.updateIsDiscard()
+}
+
+// updateIsDiscard recomputes the isDiscard fast-path flag; call it whenever
+// out or the sink list changes.
+func (l *Logger) updateIsDiscard() {
+	discard := l.Writer() == io.Discard
+	if discard {
+		if sinks := l.sinks.Load(); sinks != nil {
+			for _, s := range *sinks {
+				if s.w != io.Discard {
+					discard = false
+					break
+				}
+			}
+		}
+	}
+	l.isDiscard.Store(discard)
+}
+
+// isTerminal reports whether w looks like an interactive terminal, so that
+// logjam can auto-disable ANSI escapes when writing to a file or pipe.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// SetLevel sets the minimum level that Debugf/Infof/Warnf/Errorf (and the
+// Panic/Fatal family) will emit; entries below it are dropped before the
+// header is built or anything is written. The message text itself has
+// already been formatted by the calling method.
+func (l *Logger) SetLevel(lv int) {
+	l.level.Store(int64(lv))
+}
+
+// NoColor reports whether ANSI color output is force-disabled.
+func (l *Logger) NoColor() bool {
+	return l.noColor.Load()
+}
+
+// SetNoColor force-disables (or re-enables) all ANSI codes, regardless of
+// whether out is detected as a terminal.
+func (l *Logger) SetNoColor(v bool) {
+	l.noColor.Store(v)
+}
+
+// colorEnabled reports whether it's safe to emit ANSI escapes: out must
+// look like a terminal and the caller must not have opted out.
+func (l *Logger) colorEnabled() bool {
+	return l.term.Load() && !l.noColor.Load()
+}
+
+// Flags returns the output flags for the logger.
+func (l *Logger) Flags() int {
+	return int(l.flag.Load())
+}
+
+// SetFlags sets the output flags for the logger.
+func (l *Logger) SetFlags(flag int) {
+	l.flag.Store(int64(flag))
 }
 
 func (l *Logger) SetHeatingUp(hup int) {
-	l.mu.Lock()
-	defer l.mu.Unlock()
-	l.rateHeatingUp = hup
+	l.rateHeatingUp.Store(int64(hup))
 }
 
 func (l *Logger) SetOnFire(of int) {
-	l.mu.Lock()
-	defer l.mu.Unlock()
-	l.rateOnFire = of
+	l.rateOnFire.Store(int64(of))
 }
 
 func (l *Logger) SetBlazing(b int) {
-	l.mu.Lock()
-	defer l.mu.Unlock()
-	l.periodsBlazing = int64(b)
+	l.periodsBlazing.Store(int64(b))
 }
 
-func (l *Logger) updateHeat(now time.Time) {
-	l.rate += 1
-	period := now.Unix()
-	if l.period == period {
-		return
+// tick bumps the call count for the current one-second period and reports
+// it back along with whether this call is the first to observe a new
+// period. On that first call the count starts over at 1, and the returned
+// rate is instead the count of the period that just ended plus this call,
+// which is what updateHeat evaluates. Only the caller that wins the CAS into a new period evaluates the
+// heat state machine for the period that just ended, so updateHeat never
+// runs concurrently with itself without any locking required.
+func (l *Logger) tick(now time.Time) (rate int64, rolled bool) {
+	period := uint64(uint32(now.Unix()))
+	for {
+		old := l.periodRate.Load()
+		oldPeriod, oldCount := old>>32, old&0xffffffff
+		if oldPeriod == period {
+			next := old + 1
+			if l.periodRate.CompareAndSwap(old, next) {
+				return int64(oldCount + 1), false
+			}
+			continue
+		}
+		next := (period << 32) | 1
+		if l.periodRate.CompareAndSwap(old, next) {
+			return int64(oldCount + 1), true
+		}
 	}
+}
 
-	// reset
-	l.period = period
+func (l *Logger) updateHeat(rate int64, period int64) {
+	l.lastRate.Store(rate)
+	state := heatState(l.state.Load())
 
-	switch l.state {
+	switch state {
 	case cold:
-		l.heat = nil
-		if l.rate > l.rateHeatingUp {
-			l.announce = "It's heating up!!! "
-			l.state = heatingUp
-			l.heat = heating
+		l.clearHeat()
+		if rate > l.rateHeatingUp.Load() {
+			l.setAnnounce("It's heating up!!! ")
+			l.state.Store(int64(heatingUp))
+			l.storeHeat(heating, heatNameHeating)
 		}
-		break
 
 	case coolingDown:
-		if l.rate > l.rateHeatingUp {
-			l.heat = heating
-			l.state = heatingUp
-		} else if l.rate < l.rateHeatingUp {
-			l.heat = nil
-			l.state = cold
+		if rate > l.rateHeatingUp.Load() {
+			l.storeHeat(heating, heatNameHeating)
+			l.state.Store(int64(heatingUp))
+		} else if rate < l.rateHeatingUp.Load() {
+			l.clearHeat()
+			l.state.Store(int64(cold))
 		}
-		break
 
 	case heatingUp:
-		l.heat = heating
-		if l.rate > l.rateOnFire {
-			l.announce = "It's on fire!!! "
-			l.state = onFire
-			l.firePeriod = period
-			l.heat = fire
+		l.storeHeat(heating, heatNameHeating)
+		if rate > l.rateOnFire.Load() {
+			l.setAnnounce("It's on fire!!! ")
+			l.state.Store(int64(onFire))
+			l.firePeriod.Store(period)
+			l.storeHeat(fire, heatNameFire)
 		}
-		break
 
 	case onFire:
-		l.heat = fire
+		l.storeHeat(fire, heatNameFire)
 		// maybe we cooled off.
-		if l.rate < l.rateOnFire {
-			l.state = coolingDown
-			l.heat = heating
+		if rate < l.rateOnFire.Load() {
+			l.state.Store(int64(coolingDown))
+			l.storeHeat(heating, heatNameHeating)
 			break
 		}
-		if l.firePeriod+l.periodsBlazing < period {
-			l.announce = "Boomshakalaka!!! "
-			l.heat = blazing
+		if l.firePeriod.Load()+l.periodsBlazing.Load() < period {
+			l.setAnnounce("Boomshakalaka!!! ")
+			l.storeHeat(blazing, heatNameBlazing)
+		}
+	}
+}
+
+// heatState is just int64 with a name, so switches over l.state.Load() read
+// naturally alongside the cold/coolingDown/heatingUp/onFire constants.
+type heatState = int64
+
+func heatStateName(s heatState) string {
+	switch s {
+	case cold:
+		return "cold"
+	case coolingDown:
+		return "coolingDown"
+	case heatingUp:
+		return "heatingUp"
+	case onFire:
+		return "onFire"
+	default:
+		return "unknown"
+	}
+}
+
+// Names for the active heat func, reported in JSON records so downstream
+// tooling can alert on "blazing" without parsing ANSI codes.
+const (
+	heatNameNone    = "none"
+	heatNameHeating = "heating"
+	heatNameFire    = "fire"
+	heatNameBlazing = "blazing"
+)
+
+func (l *Logger) storeHeat(h heatFunc, name string) {
+	l.heat.Store(&h)
+	l.heatName.Store(&name)
+}
+
+func (l *Logger) clearHeat() {
+	l.heat.Store(nil)
+	name := heatNameNone
+	l.heatName.Store(&name)
+}
+
+func (l *Logger) setAnnounce(a string) {
+	l.announce.Store(&a)
+}
+
+// Cheap integer to fixed-width decimal ASCII. Give a negative width to avoid
+// zero-padding. Knows the buffer has capacity.
+func itoa(buf *[]byte, i int, wid int) {
+	var b [20]byte
+	bp := len(b) - 1
+	for i >= 10 || wid > 1 {
+		wid--
+		q := i / 10
+		b[bp] = byte('0' + i - q*10)
+		bp--
+		i = q
+	}
+	b[bp] = byte('0' + i)
+	*buf = append(*buf, b[bp:]...)
+}
+
+// formatHeader writes a log header to buf in the manner of the standard
+// library's log package: an optional prefix, the date/time (optionally in
+// UTC), and the file:line of the caller, depending on flag.
+func formatHeader(buf []byte, prefix string, flag int64, t time.Time, file string, line int) []byte {
+	if prefix != "" && flag&Lmsgprefix == 0 {
+		buf = append(buf, prefix...)
+	}
+	if flag&(Ldate|Ltime|Lmicroseconds) != 0 {
+		if flag&LUTC != 0 {
+			t = t.UTC()
+		}
+		if flag&Ldate != 0 {
+			year, month, day := t.Date()
+			itoa(&buf, year, 4)
+			buf = append(buf, '/')
+			itoa(&buf, int(month), 2)
+			buf = append(buf, '/')
+			itoa(&buf, day, 2)
+			buf = append(buf, ' ')
+		}
+		if flag&(Ltime|Lmicroseconds) != 0 {
+			hour, min, sec := t.Clock()
+			itoa(&buf, hour, 2)
+			buf = append(buf, ':')
+			itoa(&buf, min, 2)
+			buf = append(buf, ':')
+			itoa(&buf, sec, 2)
+			if flag&Lmicroseconds != 0 {
+				buf = append(buf, '.')
+				itoa(&buf, t.Nanosecond()/1e3, 6)
+			}
+			buf = append(buf, ' ')
+		}
+	}
+	if flag&(Lshortfile|Llongfile) != 0 {
+		if flag&Lshortfile != 0 {
+			short := file
+			for i := len(file) - 1; i > 0; i-- {
+				if file[i] == '/' {
+					short = file[i+1:]
+					break
+				}
+			}
+			file = short
 		}
+		buf = append(buf, file...)
+		buf = append(buf, ':')
+		itoa(&buf, line, -1)
+		buf = append(buf, ": "...)
+	}
+	if prefix != "" && flag&Lmsgprefix != 0 {
+		buf = append(buf, prefix...)
 	}
-	l.rate = 0
+	return buf
 }
 
-func (l *Logger) Output(s string) error {
+// Output writes the output for a logging event. The string s contains the
+// text to print after the header generated by the flags of the Logger.
+// calldepth is used to recover the PC, and is provided for generality,
+// although at the moment on all pre-defined paths it will be 2.
+//
+// Configuration (prefix, flag, output writer, rate thresholds) is read from
+// atomic fields and formatting happens into a pooled buffer, so concurrent
+// calls never contend with each other until the final write to out, which
+// mu serializes to keep lines from interleaving.
+func (l *Logger) Output(calldepth int, s string) error {
+	return l.write(calldepth+1, -1, nil, s)
+}
+
+// outputLevel is Output's leveled counterpart, used by Debugf/Infof/Warnf/
+// Errorf and the Panic/Fatal family. Entries below the logger's configured
+// level are dropped before the header is built or anything is written.
+func (l *Logger) outputLevel(calldepth int, lv Level, s string) error {
+	if lv < Level(l.level.Load()) {
+		return nil
+	}
+	return l.write(calldepth+1, lv, nil, s)
+}
+
+// write is the shared implementation behind Output, outputLevel, and Entry.
+// lv is the level of the entry, or -1 for unleveled calls made through
+// Output. fields is non-nil only for entries built with WithFields.
+func (l *Logger) write(calldepth int, lv Level, fields map[string]any, s string) error {
+	if l.isDiscard.Load() {
+		return nil
+	}
+
 	now := time.Now() // get this early.
-	l.mu.Lock()
-	defer l.mu.Unlock()
-	l.buf = l.buf[:0]
-	l.updateHeat(now)
+	flag := l.Flags()
+	hasLevel := lv >= 0
+	jsonMode := Format(l.format.Load()) == FormatJSON
+
+	var file string
+	var line int
+	if !jsonMode && flag&(Lshortfile|Llongfile) != 0 {
+		var ok bool
+		_, file, line, ok = runtime.Caller(calldepth)
+		if !ok {
+			file = "???"
+			line = 0
+		}
+	}
 
-	if l.announce != "" {
-		l.buf = append(l.buf, announce(l.announce)...)
-		l.announce = ""
+	rate, rolled := l.tick(now)
+	if rolled {
+		l.updateHeat(rate, now.Unix())
 	}
 
-	nl := len(s) == 0 || s[len(s)-1] != '\n'
+	bufp := getBuffer()
+	defer putBuffer(bufp)
+	buf := *bufp
 
-	if l.heat != nil && l.term {
-		l.buf = append(l.buf, l.heat([]byte(s))...)
+	if jsonMode {
+		buf = l.appendJSON(buf, now, hasLevel, lv, fields, s)
 	} else {
-		l.buf = append(l.buf, s...)
+		buf = l.appendText(buf, now, flag, hasLevel, lv, file, line, fields, s)
 	}
+	*bufp = buf
 
-	if nl {
-		l.buf = append(l.buf, '\n')
+	l.mu.Lock()
+	_, err := l.Writer().Write(buf)
+	if sinks := l.sinks.Load(); sinks != nil {
+		for _, snk := range *sinks {
+			if hasLevel && int64(lv) < snk.minLevel {
+				continue
+			}
+			sb := buf
+			if snk.stripANSI {
+				sb = stripANSI(buf)
+			}
+			snk.w.Write(sb)
+		}
 	}
-	_, err := l.out.Write(l.buf)
+	l.mu.Unlock()
 
 	return err
 }
 
+// appendText renders one line in the default text format: the optional
+// "heating up"/"on fire" announcement, the stdlib-style header, an
+// optional colorized "[LEVEL] " tag, the message, any WithFields fields
+// rendered as trailing "key=value" pairs, with heat coloring applied on
+// top. The announce banner is already fully escaped (color + reset) by the
+// time it's produced, so it's prepended outside the heat-colored span
+// rather than colored along with it — otherwise its own embedded reset
+// would terminate the heat color early and, under fire, its escape bytes
+// would get interleaved into the per-byte coloring.
+func (l *Logger) appendText(buf []byte, now time.Time, flag int, hasLevel bool, lv Level, file string, line int, fields map[string]any, s string) []byte {
+	var ann []byte
+	if ap := l.announce.Swap(nil); ap != nil && *ap != "" {
+		if l.colorEnabled() {
+			ann = announce(*ap)
+		} else {
+			ann = []byte(*ap)
+		}
+	}
+
+	buf = formatHeader(buf, l.Prefix(), int64(flag), now, file, line)
+	headerEnd := len(buf)
+
+	colorOn := l.colorEnabled()
+	colorTag := hasLevel && flag&Llevel != 0 && colorOn && flag&(Lshortcolor|Llongcolor) != 0
+	longColor := flag&Llongcolor != 0
+
+	if hasLevel && flag&Llevel != 0 {
+		buf = append(buf, '[')
+		buf = append(buf, lv.String()...)
+		buf = append(buf, "] "...)
+	}
+	tagEnd := len(buf)
+
+	msg := strings.TrimSuffix(s, "\n")
+	buf = append(buf, msg...)
+	buf = appendFields(buf, fields)
+	buf = append(buf, '\n')
+
+	hp := l.heat.Load()
+	heatActive := hp != nil && colorOn
+
+	switch {
+	case heatActive && tagEnd == headerEnd:
+		// No level tag: color the whole assembled line in one pass, same
+		// as an unleveled logger, so heat patterns like fire's alternating
+		// colors run continuously across header and message.
+		buf = (*hp)(buf)
+	case heatActive:
+		// Heat colors the header and message body; the level tag keeps
+		// its own color (or stays plain) so it still reads at a glance
+		// when the logger is hot.
+		head := (*hp)(buf[:headerEnd])
+		body := (*hp)(buf[tagEnd:])
+		tag := buf[headerEnd:tagEnd]
+		if colorTag {
+			tag = wrapColor(lv.color(), tag)
+		}
+		buf = concatBuf(head, tag, body)
+	case colorTag && longColor:
+		buf = wrapColor(lv.color(), buf)
+	case colorTag:
+		tag := wrapColor(lv.color(), buf[headerEnd:tagEnd])
+		buf = concatBuf(buf[:headerEnd], tag, buf[tagEnd:])
+	}
+
+	if len(ann) > 0 {
+		buf = concatBuf(ann, buf)
+	}
+	return buf
+}
+
+// appendFields renders WithFields fields as trailing " key=value" pairs,
+// sorted by key so the same Entry always renders identically.
+func appendFields(buf []byte, fields map[string]any) []byte {
+	if len(fields) == 0 {
+		return buf
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		buf = append(buf, ' ')
+		buf = append(buf, k...)
+		buf = append(buf, '=')
+		buf = append(buf, fmt.Sprint(fields[k])...)
+	}
+	return buf
+}
+
+// jsonRecord is the shape of one FormatJSON line. Field order matches
+// encoding/json's struct-field order, so the ts/msg/state/rate/heat
+// prefix of every record is stable.
+type jsonRecord struct {
+	TS       string         `json:"ts"`
+	Msg      string         `json:"msg"`
+	State    string         `json:"state"`
+	Rate     int64          `json:"rate"`
+	Heat     string         `json:"heat"`
+	Level    string         `json:"level,omitempty"`
+	Fields   map[string]any `json:"fields,omitempty"`
+	Announce string         `json:"announce,omitempty"`
+}
+
+// appendJSON renders one line as a JSON object carrying the current heat
+// state and rate-per-second, so downstream tooling can alert when a
+// service goes "on fire". It never emits ANSI escapes. Like appendText, it
+// consumes any pending announce so the message doesn't linger and fire on
+// the first line after a switch back to FormatText.
+func (l *Logger) appendJSON(buf []byte, now time.Time, hasLevel bool, lv Level, fields map[string]any, s string) []byte {
+	rec := jsonRecord{
+		TS:    now.Format(time.RFC3339Nano),
+		Msg:   strings.TrimSuffix(s, "\n"),
+		State: heatStateName(heatState(l.state.Load())),
+		Rate:  l.lastRate.Load(),
+		Heat:  *l.heatName.Load(),
+	}
+	if hasLevel {
+		rec.Level = lv.String()
+	}
+	if len(fields) > 0 {
+		rec.Fields = fields
+	}
+	if ap := l.announce.Swap(nil); ap != nil && *ap != "" {
+		rec.Announce = *ap
+	}
+
+	enc, err := json.Marshal(rec)
+	if err != nil {
+		enc = []byte(`{"msg":` + strconv.Quote(rec.Msg) + `}`)
+	}
+	buf = append(buf, enc...)
+	buf = append(buf, '\n')
+	return buf
+}
+
+// wrapColor returns a new slice with txt wrapped in the given ANSI color
+// and a trailing reset.
+func wrapColor(color string, txt []byte) []byte {
+	out := make([]byte, 0, len(color)+len(txt)+len(reset))
+	out = append(out, color...)
+	out = append(out, txt...)
+	out = append(out, reset...)
+	return out
+}
+
+// ansiEscape matches the CSI color sequences this package emits, so
+// StripANSI sinks can cheaply remove them.
+var ansiEscape = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+func stripANSI(b []byte) []byte {
+	if !bytes.ContainsRune(b, 0x1b) {
+		return b
+	}
+	return ansiEscape.ReplaceAll(b, nil)
+}
+
+// concatBuf joins parts into a single freshly-allocated slice.
+func concatBuf(parts ...[]byte) []byte {
+	n := 0
+	for _, p := range parts {
+		n += len(p)
+	}
+	out := make([]byte, 0, n)
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+	return out
+}
+
 func (l *Logger) Printf(format string, v ...interface{}) {
-	l.Output(fmt.Sprintf(format, v...))
+	l.Output(2, fmt.Sprintf(format, v...))
 }
 
 func (l *Logger) Print(v ...interface{}) {
-	l.Output(fmt.Sprint(v...))
+	l.Output(2, fmt.Sprint(v...))
 }
 
 func (l *Logger) Println(v ...interface{}) {
-	l.Output(fmt.Sprintln(v...))
+	l.Output(2, fmt.Sprintln(v...))
 }
 
 func (l *Logger) Fatal(v ...interface{}) {
-	l.Output(fmt.Sprint(v...))
+	l.outputLevel(2, Fatal, fmt.Sprint(v...))
 	os.Exit(1)
 }
 
 func (l *Logger) Fatalf(format string, v ...interface{}) {
-	l.Output(fmt.Sprintf(format, v...))
+	l.outputLevel(2, Fatal, fmt.Sprintf(format, v...))
 	os.Exit(1)
 }
 
 func (l *Logger) Fatalln(v ...interface{}) {
-	l.Output(fmt.Sprintln(v...))
+	l.outputLevel(2, Fatal, fmt.Sprintln(v...))
 	os.Exit(1)
 }
 
 func (l *Logger) Panic(v ...interface{}) {
 	s := fmt.Sprint(v...)
-	l.Output(s)
+	l.outputLevel(2, Panic, s)
 	panic(s)
 }
 
 func (l *Logger) Panicf(format string, v ...interface{}) {
 	s := fmt.Sprintf(format, v...)
-	l.Output(s)
+	l.outputLevel(2, Panic, s)
 	panic(s)
 }
 
 func (l *Logger) Panicln(v ...interface{}) {
 	s := fmt.Sprintln(v...)
-	l.Output(s)
+	l.outputLevel(2, Panic, s)
 	panic(s)
 }
 
+// Debugf logs at Debug level, formatting arguments in the manner of fmt.Sprintf.
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	l.outputLevel(2, Debug, fmt.Sprintf(format, v...))
+}
+
+// Infof logs at Info level, formatting arguments in the manner of fmt.Sprintf.
+func (l *Logger) Infof(format string, v ...interface{}) {
+	l.outputLevel(2, Info, fmt.Sprintf(format, v...))
+}
+
+// Warnf logs at Warn level, formatting arguments in the manner of fmt.Sprintf.
+func (l *Logger) Warnf(format string, v ...interface{}) {
+	l.outputLevel(2, Warn, fmt.Sprintf(format, v...))
+}
+
+// Errorf logs at Error level, formatting arguments in the manner of fmt.Sprintf.
+func (l *Logger) Errorf(format string, v ...interface{}) {
+	l.outputLevel(2, Error, fmt.Sprintf(format, v...))
+}
+
+// Entry accumulates structured fields to attach to a single log line,
+// built with WithFields. It is pooled: call exactly one of its logging
+// methods to flush the fields and the message and return the Entry to the
+// pool. An Entry must not be reused or shared across goroutines.
+type Entry struct {
+	l      *Logger
+	fields map[string]any
+}
+
+var entryPool = sync.Pool{
+	New: func() any { return &Entry{fields: make(map[string]any, 4)} },
+}
+
+// WithFields returns an Entry that will attach fields to the next message
+// logged through it. The Entry comes from a pool, so building one doesn't
+// allocate on the hot path beyond copying the given fields in.
+func (l *Logger) WithFields(fields map[string]any) *Entry {
+	e := entryPool.Get().(*Entry)
+	e.l = l
+	for k, v := range fields {
+		e.fields[k] = v
+	}
+	return e
+}
+
+// log writes s at level lv (or -1 for unleveled) with the Entry's
+// accumulated fields, then releases the Entry back to the pool.
+func (e *Entry) log(lv Level, s string) {
+	l := e.l
+	fields := e.fields
+	defer e.release()
+
+	if lv >= 0 && lv < Level(l.level.Load()) {
+		return
+	}
+	l.write(3, lv, fields, s)
+}
+
+func (e *Entry) release() {
+	for k := range e.fields {
+		delete(e.fields, k)
+	}
+	e.l = nil
+	entryPool.Put(e)
+}
+
+func (e *Entry) Printf(format string, v ...interface{}) {
+	e.log(-1, fmt.Sprintf(format, v...))
+}
+
+func (e *Entry) Print(v ...interface{}) {
+	e.log(-1, fmt.Sprint(v...))
+}
+
+func (e *Entry) Println(v ...interface{}) {
+	e.log(-1, fmt.Sprintln(v...))
+}
+
+// Debugf logs at Debug level, formatting arguments in the manner of fmt.Sprintf.
+func (e *Entry) Debugf(format string, v ...interface{}) {
+	e.log(Debug, fmt.Sprintf(format, v...))
+}
+
+// Infof logs at Info level, formatting arguments in the manner of fmt.Sprintf.
+func (e *Entry) Infof(format string, v ...interface{}) {
+	e.log(Info, fmt.Sprintf(format, v...))
+}
+
+// Warnf logs at Warn level, formatting arguments in the manner of fmt.Sprintf.
+func (e *Entry) Warnf(format string, v ...interface{}) {
+	e.log(Warn, fmt.Sprintf(format, v...))
+}
+
+// Errorf logs at Error level, formatting arguments in the manner of fmt.Sprintf.
+func (e *Entry) Errorf(format string, v ...interface{}) {
+	e.log(Error, fmt.Sprintf(format, v...))
+}
+
 // Prefix returns the output prefix for the logger.
 func (l *Logger) Prefix() string {
-	l.mu.Lock()
-	defer l.mu.Unlock()
-	return l.prefix
+	return *l.prefix.Load()
 }
 
 // SetPrefix sets the output prefix for the logger.
 func (l *Logger) SetPrefix(prefix string) {
-	l.mu.Lock()
-	defer l.mu.Unlock()
-	l.prefix = prefix
+	l.prefix.Store(&prefix)
 }
 
 // Writer returns the output destination for the logger.
 func (l *Logger) Writer() io.Writer {
-	l.mu.Lock()
-	defer l.mu.Unlock()
-	return l.out
+	return *l.out.Load()
+}
+
+// Flush drains any sink added with a nonzero SinkOptions.BufferSize.
+// Buffered sinks hold lines in memory until their bufio.Writer fills, so
+// callers that add one must call Flush before exiting or that tail of
+// output is lost.
+func (l *Logger) Flush() error {
+	sinks := l.sinks.Load()
+	if sinks == nil {
+		return nil
+	}
+	var firstErr error
+	for _, s := range *sinks {
+		f, ok := s.w.(interface{ Flush() error })
+		if !ok {
+			continue
+		}
+		if err := f.Flush(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
 }